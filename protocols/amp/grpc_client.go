@@ -0,0 +1,119 @@
+//go:build amp_grpc
+
+// This file depends on the generated protocols/amp/proto stubs, which are
+// gitignored build output (see Makefile's `proto` target). Build with
+// `-tags amp_grpc` only after running `make proto`; the default build uses
+// the stub in grpc_stub.go instead.
+package amp
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/antongulenko/RTP/protocols"
+	amppb "github.com/antongulenko/RTP/protocols/amp/proto"
+)
+
+// GRPCClient is a gRPC-backed implementation of the amp Client used by
+// BalancingPlugin/BackendServer. It keeps the same NewClient/SetServer/Close
+// lifecycle as the legacy client so BackendServer can treat both transports
+// identically; only the wire calls underneath become typed RPCs with
+// per-call deadlines.
+type GRPCClient struct {
+	addr string
+	opts GRPCOptions
+	conn *grpc.ClientConn
+	stub amppb.AmpTransportClient
+}
+
+// NewGRPCClient creates a client that is not yet connected to a server; call
+// SetServer to dial the backend, mirroring the legacy client's lifecycle.
+func NewGRPCClient(opts GRPCOptions) *GRPCClient {
+	return &GRPCClient{opts: opts.withDefaults()}
+}
+
+func (c *GRPCClient) SetServer(addr string) error {
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	creds := insecure.NewCredentials()
+	if c.opts.TLSConfig != nil {
+		creds = credentials.NewTLS(c.opts.TLSConfig)
+	}
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds), grpc.WithBlock(), grpc.WithTimeout(c.opts.DialTimeout))
+	if err != nil {
+		return fmt.Errorf("Error dialing gRPC AMP backend %v: %v", addr, err)
+	}
+	c.addr = addr
+	c.conn = conn
+	c.stub = amppb.NewAmpTransportClient(conn)
+	return nil
+}
+
+func (c *GRPCClient) StartStream(ctx context.Context, val *StartStream) error {
+	ack, err := c.stub.StartStream(ctx, &amppb.StartStreamRequest{
+		Client:    val.Client,
+		MediaFile: val.File,
+		Port:      int32(val.Port),
+	})
+	return checkAck(ack, err)
+}
+
+func (c *GRPCClient) StopStream(ctx context.Context, val *StopStream) error {
+	ack, err := c.stub.StopStream(ctx, &amppb.StopStreamRequest{Client: val.Client})
+	return checkAck(ack, err)
+}
+
+func checkAck(ack *amppb.Ack, err error) error {
+	if err != nil {
+		return err
+	}
+	if !ack.Ok {
+		return fmt.Errorf("%s", ack.Error)
+	}
+	return nil
+}
+
+func (c *GRPCClient) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func (c *GRPCClient) String() string {
+	return c.addr
+}
+
+// BackendCircuitBreaker adapts a GRPCClient to the protocols.CircuitBreaker
+// surface balancer.BackendServer expects, so a grpc:// backend can be
+// registered exactly like a legacy one (see balancer.BalancingPlugin's
+// addGRPCBackendServer). Error/AddCallback are delegated straight through to
+// the FaultDetector the balancer already runs against the backend; this
+// type adds no circuit-breaking behavior of its own.
+type BackendCircuitBreaker struct {
+	*GRPCClient
+	detector protocols.FaultDetector
+}
+
+// NewGRPCBackend dials a gRPC AMP backend at addr (without the "grpc://"
+// scheme) and wraps it for use as a balancer.BackendServer's Client.
+func NewGRPCBackend(addr string, detector protocols.FaultDetector, opts GRPCOptions) (*BackendCircuitBreaker, error) {
+	client := NewGRPCClient(opts)
+	if err := client.SetServer(addr); err != nil {
+		return nil, err
+	}
+	return &BackendCircuitBreaker{GRPCClient: client, detector: detector}, nil
+}
+
+func (b *BackendCircuitBreaker) Error() error {
+	return b.detector.Error()
+}
+
+func (b *BackendCircuitBreaker) AddCallback(cb protocols.FaultDetectorCallback, key interface{}) {
+	b.detector.AddCallback(cb, key)
+}
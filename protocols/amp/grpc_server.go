@@ -0,0 +1,77 @@
+//go:build amp_grpc
+
+// This file depends on the generated protocols/amp/proto stubs, which are
+// gitignored build output (see Makefile's `proto` target). Build with
+// `-tags amp_grpc` only after running `make proto`; the default build uses
+// the stub in grpc_stub.go instead.
+package amp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	amppb "github.com/antongulenko/RTP/protocols/amp/proto"
+)
+
+// grpcHandlerAdapter exposes the existing amp.Handler over the generated
+// AmpTransportServer interface, so Handler implementations are shared
+// between the legacy and gRPC transports.
+type grpcHandlerAdapter struct {
+	amppb.UnimplementedAmpTransportServer
+	handler Handler
+	logger  interface {
+		Errorw(msg string, keysAndValues ...interface{})
+	}
+}
+
+func (a *grpcHandlerAdapter) StartStream(ctx context.Context, req *amppb.StartStreamRequest) (*amppb.Ack, error) {
+	err := a.handler.StartStream(&StartStream{
+		Client: req.Client,
+		File:   req.MediaFile,
+		Port:   int(req.Port),
+	})
+	return ackFor(err), nil
+}
+
+func (a *grpcHandlerAdapter) StopStream(ctx context.Context, req *amppb.StopStreamRequest) (*amppb.Ack, error) {
+	err := a.handler.StopStream(&StopStream{Client: req.Client})
+	return ackFor(err), nil
+}
+
+func ackFor(err error) *amppb.Ack {
+	if err == nil {
+		return &amppb.Ack{Ok: true}
+	}
+	return &amppb.Ack{Ok: false, Error: err.Error()}
+}
+
+// NewGRPCServer starts a gRPC-backed AMP server listening on local_addr. It
+// serves the same Handler interface as the legacy NewServer, so callers can
+// switch transports without touching their StartStream/StopStream logic.
+func NewGRPCServer(local_addr string, handler Handler, opts GRPCOptions) (*grpc.Server, net.Listener, error) {
+	if handler == nil {
+		return nil, nil, fmt.Errorf("Need non-nil amp.Handler")
+	}
+	listener, err := net.Listen("tcp", local_addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error listening on %v: %v", local_addr, err)
+	}
+	var serverOpts []grpc.ServerOption
+	if opts.TLSConfig != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(opts.TLSConfig)))
+	}
+	grpcServer := grpc.NewServer(serverOpts...)
+	amppb.RegisterAmpTransportServer(grpcServer, &grpcHandlerAdapter{handler: handler})
+	return grpcServer, listener, nil
+}
+
+// GRPCClientTLSConfig builds a minimal client-side tls.Config from a CA
+// certificate pool. Left to the caller to populate RootCAs/Certificates.
+func GRPCClientTLSConfig() *tls.Config {
+	return &tls.Config{}
+}
@@ -0,0 +1,40 @@
+//go:build !amp_grpc
+
+package amp
+
+import (
+	"fmt"
+	"net"
+
+	"google.golang.org/grpc"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+// This build does not have the generated protocols/amp/proto stubs (run
+// `make proto`, then rebuild with `-tags amp_grpc`), so NewGRPCServer and
+// NewGRPCBackend are stubbed out to fail loudly instead of leaving the
+// package unbuildable. See grpc_server.go/grpc_client.go for the real
+// implementations.
+
+func NewGRPCServer(local_addr string, handler Handler, opts GRPCOptions) (*grpc.Server, net.Listener, error) {
+	return nil, nil, fmt.Errorf("gRPC AMP transport not compiled in: run `make proto` and rebuild with -tags amp_grpc")
+}
+
+func NewGRPCBackend(addr string, detector protocols.FaultDetector, opts GRPCOptions) (*BackendCircuitBreaker, error) {
+	return nil, fmt.Errorf("gRPC AMP transport not compiled in: run `make proto` and rebuild with -tags amp_grpc")
+}
+
+// BackendCircuitBreaker is declared here too, with the same method set as
+// the real implementation in grpc_client.go, so code that assigns it to a
+// protocols.CircuitBreaker field type-checks regardless of build tag.
+// NewGRPCBackend above always errors in this build, so no instance ever
+// actually exists.
+type BackendCircuitBreaker struct{}
+
+func (b *BackendCircuitBreaker) SetServer(addr string) error { return nil }
+func (b *BackendCircuitBreaker) Close() error                { return nil }
+func (b *BackendCircuitBreaker) Error() error                { return nil }
+func (b *BackendCircuitBreaker) String() string              { return "" }
+func (b *BackendCircuitBreaker) AddCallback(cb protocols.FaultDetectorCallback, key interface{}) {
+}
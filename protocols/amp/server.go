@@ -2,14 +2,17 @@ package amp
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/metrics"
 )
 
 type Server struct {
 	*protocols.Server
 	*ampProtocol
 	handler Handler
+	logger  protocols.Logger
 }
 
 type Handler interface {
@@ -18,11 +21,14 @@ type Handler interface {
 	StopServer()
 }
 
-func NewServer(local_addr string, handler Handler) (server *Server, err error) {
+func NewServer(local_addr string, handler Handler, logger protocols.Logger) (server *Server, err error) {
 	if handler == nil {
 		return nil, fmt.Errorf("Need non-nil amp.Handler")
 	}
-	server = &Server{handler: handler}
+	if logger == nil {
+		logger = protocols.NoopLogger()
+	}
+	server = &Server{handler: handler, logger: logger.Named("amp")}
 	server.Server, err = protocols.NewServer(local_addr, server)
 	if err != nil {
 		server = nil
@@ -36,20 +42,35 @@ func (server *Server) StopServer() {
 
 func (server *Server) HandleRequest(packet *protocols.Packet) {
 	val := packet.Val
+	code := strconv.Itoa(int(packet.Code))
 	switch packet.Code {
 	case CodeStartStream:
 		if desc, ok := val.(*StartStream); ok {
-			server.ReplyCheck(packet, server.handler.StartStream(desc))
+			err := server.handler.StartStream(desc)
+			metrics.AMPRequestsTotal.WithLabelValues(code, statusFor(err)).Inc()
+			server.ReplyCheck(packet, err)
 		} else {
+			metrics.AMPRequestsTotal.WithLabelValues(code, metrics.StatusError).Inc()
 			server.ReplyError(packet, fmt.Errorf("Illegal value for AMP StartStream: %v", packet.Val))
 		}
 	case CodeStopStream:
 		if desc, ok := val.(*StopStream); ok {
-			server.ReplyCheck(packet, server.handler.StopStream(desc))
+			err := server.handler.StopStream(desc)
+			metrics.AMPRequestsTotal.WithLabelValues(code, statusFor(err)).Inc()
+			server.ReplyCheck(packet, err)
 		} else {
+			metrics.AMPRequestsTotal.WithLabelValues(code, metrics.StatusError).Inc()
 			server.ReplyError(packet, fmt.Errorf("Illegal value for AMP StopStream: %v", packet.Val))
 		}
 	default:
-		server.LogError(fmt.Errorf("Received unexpected AMP code: %v", packet.Code))
+		metrics.AMPRequestsTotal.WithLabelValues(code, metrics.StatusError).Inc()
+		server.logger.Errorw("Received unexpected AMP code", "code", packet.Code)
+	}
+}
+
+func statusFor(err error) string {
+	if err != nil {
+		return metrics.StatusError
 	}
+	return metrics.StatusOK
 }
\ No newline at end of file
@@ -0,0 +1,43 @@
+package amp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// TransportMode selects the wire protocol used by a Server/Client pair.
+// ModeLegacy keeps the existing ampProtocol UDP/TCP framing; ModeGRPC
+// switches to the protobuf-defined AmpTransport service (see proto/amp.proto).
+type TransportMode string
+
+const (
+	ModeLegacy TransportMode = "legacy"
+	ModeGRPC   TransportMode = "grpc"
+
+	DefaultGRPCDialTimeout = 5 * time.Second
+)
+
+// GRPCOptions configures the gRPC transport. TLSConfig may be nil, in which
+// case the connection is established in plaintext (suitable for trusted
+// internal networks only).
+type GRPCOptions struct {
+	DialTimeout time.Duration
+	TLSConfig   *tls.Config
+}
+
+func (opts GRPCOptions) withDefaults() GRPCOptions {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultGRPCDialTimeout
+	}
+	return opts
+}
+
+func parseTransportMode(mode string) (TransportMode, error) {
+	switch TransportMode(mode) {
+	case ModeLegacy, ModeGRPC:
+		return TransportMode(mode), nil
+	default:
+		return "", fmt.Errorf("Unknown AMP transport mode %q, expected %q or %q", mode, ModeLegacy, ModeGRPC)
+	}
+}
@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"net"
+	"sync"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/metrics"
+)
+
+// BackendServer represents one media server behind a BalancingPlugin. It
+// tracks the sessions currently routed to it and the CircuitBreaker used to
+// detect/react to faults on the underlying connection.
+type BackendServer struct {
+	Addr     net.Addr
+	Client   protocols.CircuitBreaker
+	Sessions map[*BalancingSession]bool
+	Plugin   *BalancingPlugin
+
+	// Detector is the FaultDetector AddBackendServer made for this backend.
+	// Kept around so serverStateChanged can sample RTT off it (see
+	// rttSampler); may be nil for backends registered outside AddBackendServer.
+	Detector protocols.FaultDetector
+
+	// Weight influences WeightedRandom selection; defaults to 1 when unset.
+	Weight float64
+
+	// Role is RolePrimary (default, "") or RoleBackupOnly; see
+	// BalancingPlugin.pickBackend.
+	Role string
+
+	mutex    sync.Mutex
+	ewma     ewma
+	draining bool
+}
+
+// Drain marks the backend ineligible for new sessions (see
+// BalancingPlugin.NewSession) while leaving its existing sessions running,
+// so an operator can empty it out before taking it down for maintenance.
+func (server *BackendServer) Drain() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.draining = true
+}
+
+// Draining reports whether Drain has been called on this backend.
+func (server *BackendServer) Draining() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.draining
+}
+
+func (server *BackendServer) registerSession(session *BalancingSession) {
+	server.mutex.Lock()
+	server.Sessions[session] = true
+	count := len(server.Sessions)
+	server.mutex.Unlock()
+	metrics.BalancerSessions.WithLabelValues(server.Plugin.handler.Protocol().Name(), server.Addr.String()).Set(float64(count))
+}
+
+func (server *BackendServer) unregisterSession(session *BalancingSession) {
+	server.mutex.Lock()
+	delete(server.Sessions, session)
+	count := len(server.Sessions)
+	server.mutex.Unlock()
+	metrics.BalancerSessions.WithLabelValues(server.Plugin.handler.Protocol().Name(), server.Addr.String()).Set(float64(count))
+}
+
+// SessionCount returns the number of sessions currently routed to this
+// backend. Used by the LeastSessions and LatencyAware selection strategies
+// and exposed as the balancer_sessions metric.
+func (server *BackendServer) SessionCount() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return len(server.Sessions)
+}
+
+// RecordRTT feeds a freshly observed fault-detector round-trip time into
+// this backend's EWMA, consumed by the LatencyAware selection strategy.
+func (server *BackendServer) RecordRTT(rttMillis float64) {
+	server.mutex.Lock()
+	server.ewma.update(rttMillis)
+	server.mutex.Unlock()
+	metrics.FaultDetectorRTTSeconds.WithLabelValues(server.Addr.String()).Observe(rttMillis / 1000)
+}
+
+// EWMA_RTT_ms returns the current exponentially-weighted moving average RTT
+// in milliseconds, or 0 if no samples have been recorded yet.
+func (server *BackendServer) EWMA_RTT_ms() float64 {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.ewma.value
+}
+
+func (server *BackendServer) weight() float64 {
+	if server.Weight <= 0 {
+		return 1
+	}
+	return server.Weight
+}
+
+func (server *BackendServer) handleStateChanged() {
+	if server.Client.Error() != nil {
+		server.Plugin.logger.Warnw("Backend down", "backend_addr", server.Addr, "error", server.Client.Error())
+	} else {
+		server.Plugin.logger.Infow("Backend up", "backend_addr", server.Addr)
+	}
+}
+
+func (server *BackendServer) String() string {
+	return server.Addr.String()
+}
+
+// BackendServerSlice is a set of backends registered with one
+// BalancingPlugin. sort.Interface is implemented so AddBackendServer can keep
+// the slice in a stable order, which the Ketama-based ConsistentHash
+// strategy relies on for a deterministic ring.
+type BackendServerSlice []*BackendServer
+
+func (s BackendServerSlice) Len() int      { return len(s) }
+func (s BackendServerSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s BackendServerSlice) Less(i, j int) bool {
+	return s[i].Addr.String() < s[j].Addr.String()
+}
+
+// excludingBackupOnly returns the subset of s whose Role is not
+// RoleBackupOnly. Used to keep backup-only backends out of primary selection
+// (see BalancingPlugin.pickBackend).
+func (s BackendServerSlice) excludingBackupOnly() BackendServerSlice {
+	result := make(BackendServerSlice, 0, len(s))
+	for _, server := range s {
+		if server.Role != RoleBackupOnly {
+			result = append(result, server)
+		}
+	}
+	return result
+}
+
+// onlyBackupOnly returns the subset of s whose Role is RoleBackupOnly.
+func (s BackendServerSlice) onlyBackupOnly() BackendServerSlice {
+	result := make(BackendServerSlice, 0, len(s))
+	for _, server := range s {
+		if server.Role == RoleBackupOnly {
+			result = append(result, server)
+		}
+	}
+	return result
+}
+
+// ewma is a minimal exponentially-weighted moving average with a fixed
+// smoothing factor, good enough for ranking backends by recent latency.
+type ewma struct {
+	value       float64
+	initialized bool
+}
+
+const ewmaAlpha = 0.2
+
+func (e *ewma) update(sample float64) {
+	if !e.initialized {
+		e.value = sample
+		e.initialized = true
+		return
+	}
+	e.value = ewmaAlpha*sample + (1-ewmaAlpha)*e.value
+}
@@ -0,0 +1,93 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ClusterManager watches a SessionStore for sessions owned by other nodes
+// and migrates them onto this plugin's backends when their owning node's
+// lease expires. Failure is detected from the node's own liveness key
+// (WatchNodes), not from session key deletes: a session key is deleted both
+// on node failure and on ordinary, healthy session end
+// (BalancingPlugin.Cleanup), and those two cases can't be told apart from
+// the session keyspace alone. It does not own any sessions of its own;
+// BalancingPlugin publishes those directly via its SessionStore field.
+type ClusterManager struct {
+	NodeID string
+	Store  SessionStore
+	Plugin *BalancingPlugin
+}
+
+// NewClusterManager wires a SessionStore into plugin so that NewSession and
+// Cleanup publish/retract BalancingSession ownership, and starts watching
+// for peer sessions that need to be migrated on node failure.
+func NewClusterManager(nodeID string, store SessionStore, plugin *BalancingPlugin) *ClusterManager {
+	manager := &ClusterManager{NodeID: nodeID, Store: store, Plugin: plugin}
+	plugin.cluster = manager
+	return manager
+}
+
+// Run registers this node's liveness key, then watches the store until ctx
+// is cancelled: session Put/Delete events keep its view of current
+// ownership up to date, while a node liveness Delete event for some other
+// node migrates every session that node owned at the time.
+func (m *ClusterManager) Run(ctx context.Context) error {
+	known, err := m.Store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("Error loading initial cluster session state: %v", err)
+	}
+	if err := m.Store.PutNode(ctx, m.NodeID); err != nil {
+		return fmt.Errorf("Error registering node liveness: %v", err)
+	}
+	sessionEvents, err := m.Store.Watch(ctx)
+	if err != nil {
+		return fmt.Errorf("Error watching cluster session state: %v", err)
+	}
+	nodeEvents, err := m.Store.WatchNodes(ctx)
+	if err != nil {
+		return fmt.Errorf("Error watching cluster node liveness: %v", err)
+	}
+
+	var mutex sync.Mutex
+	for {
+		select {
+		case event, ok := <-sessionEvents:
+			if !ok {
+				return nil
+			}
+			mutex.Lock()
+			switch event.Type {
+			case EventPut:
+				known[event.Key] = event.Record
+			case EventDelete:
+				delete(known, event.Key)
+			}
+			mutex.Unlock()
+		case event, ok := <-nodeEvents:
+			if !ok {
+				return nil
+			}
+			if event.Type != EventDelete || event.NodeID == m.NodeID {
+				continue
+			}
+			mutex.Lock()
+			var lost []SessionRecord
+			for _, record := range known {
+				if record.NodeID == event.NodeID {
+					lost = append(lost, record)
+				}
+			}
+			mutex.Unlock()
+			m.Plugin.logger.Warnw("Peer node lease expired, migrating its sessions", "failed_node", event.NodeID, "sessions", len(lost))
+			for _, record := range lost {
+				if err := m.Plugin.migrateSession(record); err != nil {
+					m.Plugin.logger.Errorw("Failed to migrate session from failed peer", "session_client", record.Client, "error", err)
+				}
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package balancer
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const ketamaPointsPerServer = 160
+
+// ConsistentHash assigns each client to a backend using a Ketama-style hash
+// ring, so the same client address keeps hitting the same primary backend
+// across requests (session affinity) even as other backends come and go.
+// Rebuilds the ring lazily whenever the backend set changes. Pick is called
+// concurrently from BalancingPlugin.NewSession, so mutex guards the ring
+// against concurrent rebuilds.
+type ConsistentHash struct {
+	mutex    sync.Mutex
+	builtFor BackendServerSlice
+	ring     []ketamaPoint
+}
+
+type ketamaPoint struct {
+	hash   uint32
+	server *BackendServer
+}
+
+func (c *ConsistentHash) Pick(client string, servers BackendServerSlice) (*BackendServer, BackendServerSlice) {
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rebuildIfNeeded(servers)
+	hash := crc32.ChecksumIEEE([]byte(client))
+	start := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= hash })
+
+	// Walk the ring from start, collecting distinct servers: the first is the
+	// primary, the next num_backup_servers are backups.
+	seen := make(map[*BackendServer]bool, num_backup_servers+1)
+	var primary *BackendServer
+	var picked BackendServerSlice
+	for i := 0; i < len(c.ring) && len(seen) <= num_backup_servers; i++ {
+		point := c.ring[(start+i)%len(c.ring)]
+		if seen[point.server] {
+			continue
+		}
+		seen[point.server] = true
+		if primary == nil {
+			primary = point.server
+		} else {
+			picked = append(picked, point.server)
+		}
+	}
+	return primary, picked
+}
+
+func (c *ConsistentHash) rebuildIfNeeded(servers BackendServerSlice) {
+	if sameBackends(c.builtFor, servers) {
+		return
+	}
+	ring := make([]ketamaPoint, 0, len(servers)*ketamaPointsPerServer)
+	for _, server := range servers {
+		base := server.Addr.String()
+		for i := 0; i < ketamaPointsPerServer; i++ {
+			hash := crc32.ChecksumIEEE([]byte(base + "-" + strconv.Itoa(i)))
+			ring = append(ring, ketamaPoint{hash: hash, server: server})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	c.ring = ring
+	c.builtFor = append(BackendServerSlice(nil), servers...)
+}
+
+func sameBackends(a, b BackendServerSlice) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
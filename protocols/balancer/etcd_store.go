@@ -0,0 +1,156 @@
+package balancer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdSessionStore is the etcd-backed SessionStore used for amp_balancer
+// clustering/HA mode. Every Put (session or node liveness) is attached to
+// the same lease, so a crashed node's keys all disappear once the lease
+// expires; ClusterManager relies on the node liveness key specifically
+// (not session keys) to tell that apart from ordinary session churn.
+type EtcdSessionStore struct {
+	client     *clientv3.Client
+	prefix     string
+	nodePrefix string
+	leaseTTL   time.Duration
+	leaseID    clientv3.LeaseID
+}
+
+// NewEtcdSessionStore connects to the given etcd endpoints and keeps a
+// single lease alive for as long as this process is clustering. basePrefix
+// namespaces all keys (e.g. "/amp_balancer/"); sessions live under
+// basePrefix+"sessions/" and node liveness keys under basePrefix+"nodes/".
+// tlsConfig may be nil to use a plaintext connection.
+func NewEtcdSessionStore(endpoints []string, basePrefix string, leaseTTL time.Duration, tlsConfig *tls.Config) (*EtcdSessionStore, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to etcd cluster peers %v: %v", endpoints, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lease, err := client.Grant(ctx, int64(leaseTTL.Seconds()))
+	if err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("Error granting etcd lease: %v", err)
+	}
+	keepAlive, err := client.KeepAlive(context.Background(), lease.ID)
+	if err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("Error starting etcd lease keep-alive: %v", err)
+	}
+	go func() {
+		for range keepAlive {
+			// Drain keep-alive responses; nothing to do unless the channel closes,
+			// which means the lease expired and our sessions are no longer owned.
+		}
+	}()
+	return &EtcdSessionStore{
+		client:     client,
+		prefix:     basePrefix + "sessions/",
+		nodePrefix: basePrefix + "nodes/",
+		leaseTTL:   leaseTTL,
+		leaseID:    lease.ID,
+	}, nil
+}
+
+func (s *EtcdSessionStore) Put(ctx context.Context, key string, record SessionRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Error encoding session record: %v", err)
+	}
+	_, err = s.client.Put(ctx, s.prefix+key, string(data), clientv3.WithLease(s.leaseID))
+	if err != nil {
+		return fmt.Errorf("Error writing session record %v to etcd: %v", key, err)
+	}
+	return nil
+}
+
+func (s *EtcdSessionStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.Delete(ctx, s.prefix+key)
+	if err != nil {
+		return fmt.Errorf("Error deleting session record %v from etcd: %v", key, err)
+	}
+	return nil
+}
+
+func (s *EtcdSessionStore) List(ctx context.Context) (map[string]SessionRecord, error) {
+	resp, err := s.client.Get(ctx, s.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("Error listing session records from etcd: %v", err)
+	}
+	result := make(map[string]SessionRecord, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var record SessionRecord
+		if err := json.Unmarshal(kv.Value, &record); err != nil {
+			return nil, fmt.Errorf("Error decoding session record %v: %v", string(kv.Key), err)
+		}
+		result[string(kv.Key)[len(s.prefix):]] = record
+	}
+	return result, nil
+}
+
+func (s *EtcdSessionStore) Watch(ctx context.Context) (<-chan SessionEvent, error) {
+	events := make(chan SessionEvent)
+	watchChan := s.client.Watch(ctx, s.prefix, clientv3.WithPrefix())
+	go func() {
+		defer close(events)
+		for resp := range watchChan {
+			for _, ev := range resp.Events {
+				key := string(ev.Kv.Key)[len(s.prefix):]
+				if ev.Type == clientv3.EventTypeDelete {
+					events <- SessionEvent{Type: EventDelete, Key: key}
+					continue
+				}
+				var record SessionRecord
+				if err := json.Unmarshal(ev.Kv.Value, &record); err != nil {
+					continue
+				}
+				events <- SessionEvent{Type: EventPut, Key: key, Record: record}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// PutNode marks nodeID alive under this store's lease; see SessionStore.
+func (s *EtcdSessionStore) PutNode(ctx context.Context, nodeID string) error {
+	_, err := s.client.Put(ctx, s.nodePrefix+nodeID, "", clientv3.WithLease(s.leaseID))
+	if err != nil {
+		return fmt.Errorf("Error registering node %v in etcd: %v", nodeID, err)
+	}
+	return nil
+}
+
+func (s *EtcdSessionStore) WatchNodes(ctx context.Context) (<-chan NodeEvent, error) {
+	events := make(chan NodeEvent)
+	watchChan := s.client.Watch(ctx, s.nodePrefix, clientv3.WithPrefix())
+	go func() {
+		defer close(events)
+		for resp := range watchChan {
+			for _, ev := range resp.Events {
+				nodeID := string(ev.Kv.Key)[len(s.nodePrefix):]
+				eventType := EventPut
+				if ev.Type == clientv3.EventTypeDelete {
+					eventType = EventDelete
+				}
+				events <- NodeEvent{Type: eventType, NodeID: nodeID}
+			}
+		}
+	}()
+	return events, nil
+}
+
+func (s *EtcdSessionStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,59 @@
+package balancer
+
+import "math/rand"
+
+// LatencyAware ranks backends by their FaultDetector EWMA RTT
+// (BackendServer.EWMA_RTT_ms, fed by RecordRTT) using a p2c (power-of-two
+// choices) decision rule: sample two random candidates and keep the one with
+// the lower RTT. This spreads load better than always picking the single
+// lowest-latency backend while still avoiding slow ones.
+type LatencyAware struct {
+	Rand *rand.Rand // nil uses the default global source
+}
+
+func (l LatencyAware) Pick(client string, servers BackendServerSlice) (*BackendServer, BackendServerSlice) {
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	ranked := make(BackendServerSlice, 0, len(servers))
+	remaining := append(BackendServerSlice(nil), servers...)
+	for len(remaining) > 0 {
+		best := l.p2c(remaining)
+		ranked = append(ranked, best)
+		remaining = removeServer(remaining, best)
+	}
+	return ranked[0], backups(ranked[0], ranked)
+}
+
+// p2c samples two random candidates (or returns the only one) and keeps the
+// one with the lower EWMA RTT.
+func (l LatencyAware) p2c(servers BackendServerSlice) *BackendServer {
+	if len(servers) == 1 {
+		return servers[0]
+	}
+	i, j := l.intn(len(servers)), l.intn(len(servers))
+	for j == i {
+		j = l.intn(len(servers))
+	}
+	if servers[i].EWMA_RTT_ms() <= servers[j].EWMA_RTT_ms() {
+		return servers[i]
+	}
+	return servers[j]
+}
+
+func (l LatencyAware) intn(n int) int {
+	if l.Rand != nil {
+		return l.Rand.Intn(n)
+	}
+	return rand.Intn(n)
+}
+
+func removeServer(servers BackendServerSlice, target *BackendServer) BackendServerSlice {
+	result := make(BackendServerSlice, 0, len(servers)-1)
+	for _, server := range servers {
+		if server != target {
+			result = append(result, server)
+		}
+	}
+	return result
+}
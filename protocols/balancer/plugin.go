@@ -1,26 +1,67 @@
 package balancer
 
 import (
+	"context"
 	"fmt"
-	"sort"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/amp"
+	"github.com/antongulenko/RTP/protocols/metrics"
 	"github.com/antongulenko/golib"
 )
 
 const (
 	num_backup_servers    = 1
 	backup_session_weight = 0.1
+
+	clusterPublishTimeout = 2 * time.Second
 )
 
 type FaultDetectorFactory func(endpoint string) (protocols.FaultDetector, error)
 
 type BalancingPlugin struct {
-	Server         *protocols.PluginServer
+	Server *protocols.PluginServer
+
+	// BackendServers is only ever safe to read/write while holding
+	// backendsMu: AddBackendServer/RemoveBackendServer mutate it from
+	// whatever goroutine is handling a config reload (see
+	// proxies/AmpBalancer/main.go's watchConfigReload), concurrently with
+	// every live session's NewSession/eligibleBackendServers/activeSessions
+	// reading it. Use Backends() for a safe snapshot from outside this
+	// package; internal callers lock backendsMu directly.
 	BackendServers BackendServerSlice
+	backendsMu     sync.RWMutex
 
 	make_detector FaultDetectorFactory
 	handler       BalancingPluginHandler
+	logger        protocols.Logger
+	strategy      SelectionStrategy
+
+	// cluster is non-nil once NewClusterManager has wired a SessionStore into
+	// this plugin (see cluster.go). Nil means the plugin runs standalone.
+	cluster *ClusterManager
+
+	// draining is set by Shutdown to reject new sessions while letting
+	// existing ones finish (see NewSession, eligibleBackendServers).
+	draining int32
+
+	// grpcOptions configures backends registered with a "grpc://" address
+	// (see addGRPCBackendServer); zero value dials in plaintext. Set via
+	// SetGRPCOptions before AddBackendServer is called for such a backend.
+	grpcOptions amp.GRPCOptions
+}
+
+// SetGRPCOptions configures the TLS/dial settings used for any backend
+// registered with a "grpc://" address. Safe to call once during setup,
+// before backends are added; it is not safe to change concurrently with
+// AddBackendServer.
+func (plugin *BalancingPlugin) SetGRPCOptions(opts amp.GRPCOptions) {
+	plugin.grpcOptions = opts
 }
 
 type BalancingPluginHandler interface {
@@ -50,16 +91,61 @@ type BalancingSessionHandler interface {
 	HandleServerFault() (*BackendServer, error)
 }
 
-func NewBalancingPlugin(handler BalancingPluginHandler, make_detector FaultDetectorFactory) *BalancingPlugin {
+// NewBalancingPlugin creates a plugin using LeastSessions as its selection
+// strategy. Use NewBalancingPluginWithStrategy to pick a different one.
+func NewBalancingPlugin(handler BalancingPluginHandler, make_detector FaultDetectorFactory, logger protocols.Logger) *BalancingPlugin {
+	return NewBalancingPluginWithStrategy(handler, make_detector, logger, LeastSessions{})
+}
+
+func NewBalancingPluginWithStrategy(handler BalancingPluginHandler, make_detector FaultDetectorFactory, logger protocols.Logger, strategy SelectionStrategy) *BalancingPlugin {
+	if logger == nil {
+		logger = protocols.NoopLogger()
+	}
 	return &BalancingPlugin{
 		handler:        handler,
 		BackendServers: make(BackendServerSlice, 0, 10),
 		make_detector:  make_detector,
+		logger:         logger.Named("balancer").Named(handler.Protocol().Name()),
+		strategy:       strategy,
+	}
+}
+
+// BackendOptions configures a backend passed to AddBackendServer. The zero
+// value (Weight 0, Role "") behaves as it always did: equal weight, eligible
+// as primary.
+type BackendOptions struct {
+	// Weight influences WeightedRandom selection (BackendServer.Weight);
+	// non-positive means "equal weight" (1).
+	Weight float64
+
+	// Role marks a backend as RoleBackupOnly to keep it out of primary
+	// selection except as a last resort (see pickBackend); "" or
+	// RolePrimary mean the backend is eligible as primary like any other.
+	Role string
+}
+
+const (
+	RolePrimary    = "primary"
+	RoleBackupOnly = "backup-only"
+)
+
+func validateRole(role string) error {
+	switch role {
+	case "", RolePrimary, RoleBackupOnly:
+		return nil
+	default:
+		return fmt.Errorf("Unknown backend role %q, expected %q or %q", role, RolePrimary, RoleBackupOnly)
 	}
 }
 
-func (plugin *BalancingPlugin) AddBackendServer(addr string, callback protocols.FaultDetectorCallback) error {
+func (plugin *BalancingPlugin) AddBackendServer(addr string, opts BackendOptions, callback protocols.FaultDetectorCallback) error {
 	plugin.assertStarted()
+	if err := validateRole(opts.Role); err != nil {
+		return err
+	}
+	if grpcAddr, ok := strings.CutPrefix(addr, "grpc://"); ok {
+		return plugin.addGRPCBackendServer(addr, grpcAddr, opts, callback)
+	}
 	serverAddr, err := plugin.Server.Protocol().Transport().Resolve(addr)
 	if err != nil {
 		return fmt.Errorf("Error resolving backend server: %v", err)
@@ -82,11 +168,15 @@ func (plugin *BalancingPlugin) AddBackendServer(addr string, callback protocols.
 	server := &BackendServer{
 		Addr:     serverAddr,
 		Client:   client,
+		Detector: detector,
 		Sessions: make(map[*BalancingSession]bool),
 		Plugin:   plugin,
+		Weight:   opts.Weight,
+		Role:     opts.Role,
 	}
+	plugin.backendsMu.Lock()
 	plugin.BackendServers = append(plugin.BackendServers, server)
-	sort.Sort(plugin.BackendServers)
+	plugin.backendsMu.Unlock()
 	if callback != nil {
 		client.AddCallback(callback, client)
 	}
@@ -94,13 +184,105 @@ func (plugin *BalancingPlugin) AddBackendServer(addr string, callback protocols.
 	return nil
 }
 
+// addGRPCBackendServer registers a backend reached over the gRPC AMP
+// transport (protocols/amp/grpc_client.go) instead of the legacy
+// handler-provided client. Only the AMP plugin has a gRPC transport defined.
+func (plugin *BalancingPlugin) addGRPCBackendServer(addr, hostport string, opts BackendOptions, callback protocols.FaultDetectorCallback) error {
+	if plugin.handler.Protocol().Name() != "AMP" {
+		return fmt.Errorf("grpc:// backends are only supported for the AMP protocol, got %s", plugin.handler.Protocol().Name())
+	}
+	serverAddr, err := net.ResolveTCPAddr("tcp", hostport)
+	if err != nil {
+		return fmt.Errorf("Error resolving gRPC backend server: %v", err)
+	}
+	detector, err := plugin.make_detector(addr)
+	if err != nil {
+		return fmt.Errorf("Error making detector: %v", err)
+	}
+	client, err := amp.NewGRPCBackend(hostport, detector, plugin.grpcOptions)
+	if err != nil {
+		_ = detector.Close()
+		return fmt.Errorf("Error configuring gRPC client: %v", err)
+	}
+	server := &BackendServer{
+		Addr:     serverAddr,
+		Client:   client,
+		Detector: detector,
+		Sessions: make(map[*BalancingSession]bool),
+		Plugin:   plugin,
+		Weight:   opts.Weight,
+		Role:     opts.Role,
+	}
+	plugin.backendsMu.Lock()
+	plugin.BackendServers = append(plugin.BackendServers, server)
+	plugin.backendsMu.Unlock()
+	if callback != nil {
+		client.AddCallback(callback, client)
+	}
+	client.AddCallback(plugin.serverStateChanged, server)
+	return nil
+}
+
+// RemoveBackendServer closes the connection to and deregisters the backend
+// at addr, so config reloads (e.g. on SIGHUP) can shrink the backend set
+// without restarting the process. It does not touch sessions already
+// assigned to that backend; they keep running until they end naturally.
+func (plugin *BalancingPlugin) RemoveBackendServer(addr string) error {
+	plugin.assertStarted()
+	plugin.backendsMu.Lock()
+	defer plugin.backendsMu.Unlock()
+	for i, server := range plugin.BackendServers {
+		if server.Addr.String() != addr {
+			continue
+		}
+		if err := server.Client.Close(); err != nil {
+			return fmt.Errorf("Error closing connection to %s: %v", addr, err)
+		}
+		plugin.BackendServers = append(plugin.BackendServers[:i:i], plugin.BackendServers[i+1:]...)
+		plugin.logger.Infow("Backend server removed", "backend_addr", addr)
+		return nil
+	}
+	return fmt.Errorf("No %s backend registered for address %q", plugin.handler.Protocol().Name(), addr)
+}
+
+// Backends returns a snapshot of the currently registered backends, safe to
+// range over even while a concurrent AddBackendServer/RemoveBackendServer
+// (e.g. from a SIGHUP config reload) mutates the underlying slice.
+func (plugin *BalancingPlugin) Backends() BackendServerSlice {
+	plugin.backendsMu.RLock()
+	defer plugin.backendsMu.RUnlock()
+	return append(BackendServerSlice(nil), plugin.BackendServers...)
+}
+
+// UpdateBackendServer updates the Weight/Role of the already-registered
+// backend at addr in place, for a SIGHUP config reload that changes those
+// fields without changing the address itself (see applyBackends in
+// proxies/AmpBalancer/main.go). Existing sessions on the backend are
+// unaffected.
+func (plugin *BalancingPlugin) UpdateBackendServer(addr string, opts BackendOptions) error {
+	if err := validateRole(opts.Role); err != nil {
+		return err
+	}
+	for _, server := range plugin.Backends() {
+		if server.Addr.String() == addr {
+			server.Weight = opts.Weight
+			server.Role = opts.Role
+			return nil
+		}
+	}
+	return fmt.Errorf("No %s backend registered for address %q", plugin.handler.Protocol().Name(), addr)
+}
+
 func (plugin *BalancingPlugin) Start(server *protocols.PluginServer) {
 	plugin.Server = server
 }
 
 func (plugin *BalancingPlugin) NewSession(param protocols.SessionParameter) (protocols.PluginSessionHandler, error) {
+	if plugin.isDraining() {
+		return nil, fmt.Errorf("%s balancer is shutting down, not accepting new sessions", plugin.handler.Protocol().Name())
+	}
 	clientAddr := param.Client()
-	server, backups := plugin.BackendServers.pickServer(clientAddr)
+	server, backups := plugin.pickBackend(clientAddr, plugin.eligibleBackendServers())
 	if server == nil {
 		return nil, fmt.Errorf("No %s server available to handle your request", plugin.handler.Protocol().Name())
 	}
@@ -116,12 +298,26 @@ func (plugin *BalancingPlugin) NewSession(param protocols.SessionParameter) (pro
 		return nil, fmt.Errorf("Failed to create %s session: %s", plugin.handler.Protocol().Name(), err)
 	}
 	server.registerSession(session)
+	plugin.logger.Infow("Session started", "session_client", clientAddr, "backend_addr", server.Addr)
+	if plugin.cluster != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), clusterPublishTimeout)
+		defer cancel()
+		record := SessionRecord{
+			Client:      clientAddr,
+			Plugin:      plugin.handler.Protocol().Name(),
+			BackendAddr: server.Addr.String(),
+			NodeID:      plugin.cluster.NodeID,
+		}
+		if err := plugin.cluster.Store.Put(ctx, sessionKey(record.Plugin, clientAddr), record); err != nil {
+			plugin.logger.Errorw("Failed to publish session to cluster store", "session_client", clientAddr, "error", err)
+		}
+	}
 	return session, nil
 }
 
 func (plugin *BalancingPlugin) Stop() error {
 	var errors golib.MultiError
-	for _, server := range plugin.BackendServers {
+	for _, server := range plugin.Backends() {
 		if err := server.Client.Close(); err != nil {
 			errors = append(errors, fmt.Errorf("Error closing connection to %s: %v", server.Client, err))
 		}
@@ -129,14 +325,128 @@ func (plugin *BalancingPlugin) Stop() error {
 	return errors.NilOrError()
 }
 
+func (plugin *BalancingPlugin) isDraining() bool {
+	return atomic.LoadInt32(&plugin.draining) != 0
+}
+
+// eligibleBackendServers returns the backends that are not draining, i.e.
+// the ones SelectionStrategy should consider for new sessions.
+func (plugin *BalancingPlugin) eligibleBackendServers() BackendServerSlice {
+	backends := plugin.Backends()
+	eligible := make(BackendServerSlice, 0, len(backends))
+	for _, server := range backends {
+		if !server.Draining() {
+			eligible = append(eligible, server)
+		}
+	}
+	return eligible
+}
+
+// pickBackend runs the plugin's SelectionStrategy over eligible, keeping
+// RoleBackupOnly backends out of primary selection unless excluding them
+// would leave nothing to pick from at all (better a backup-only primary
+// than a failed session). Backup-only backends are always appended to the
+// backup list, since they're still fine as failover targets.
+func (plugin *BalancingPlugin) pickBackend(client string, eligible BackendServerSlice) (*BackendServer, BackendServerSlice) {
+	primaries := eligible.excludingBackupOnly()
+	pool := primaries
+	if len(pool) == 0 {
+		pool = eligible
+	}
+	server, backups := plugin.strategy.Pick(client, pool)
+	if len(primaries) < len(eligible) && len(primaries) > 0 {
+		backups = append(append(BackendServerSlice(nil), backups...), eligible.onlyBackupOnly()...)
+	}
+	return server, backups
+}
+
+func (plugin *BalancingPlugin) activeSessions() []*BalancingSession {
+	var sessions []*BalancingSession
+	for _, server := range plugin.Backends() {
+		server.mutex.Lock()
+		for session := range server.Sessions {
+			sessions = append(sessions, session)
+		}
+		server.mutex.Unlock()
+	}
+	return sessions
+}
+
+// Shutdown stops this plugin from accepting new sessions, then waits for
+// existing sessions to terminate naturally until ctx's deadline, and
+// force-closes whatever is left via BalancingSessionHandler.StopRemote. It is
+// meant to be called from the main binary's SIGTERM handler for rolling
+// restarts, or ahead of a plugin-wide maintenance window.
+func (plugin *BalancingPlugin) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&plugin.draining, 1)
+	plugin.logger.Infow("Plugin draining, no longer accepting new sessions")
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		sessions := plugin.activeSessions()
+		if len(sessions) == 0 {
+			plugin.logger.Infow("Plugin drained: all sessions stopped naturally")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			plugin.logger.Warnw("Shutdown deadline reached, force-closing remaining sessions", "remaining", len(sessions))
+			var errors golib.MultiError
+			for _, session := range sessions {
+				if err := session.Handler.StopRemote(); err != nil {
+					errors = append(errors, fmt.Errorf("Error force-closing session for %s: %v", session.Client, err))
+				}
+			}
+			return errors.NilOrError()
+		case <-ticker.C:
+		}
+	}
+}
+
+// rttSampler is implemented by FaultDetectors that track the round-trip time
+// of their last probe (the ping-based detector does); serverStateChanged uses
+// it to feed BackendServer.RecordRTT, which is what the LatencyAware strategy
+// and the FaultDetectorRTTSeconds metric are based on. Detectors that don't
+// implement it (e.g. heartbeat) simply aren't sampled.
+type rttSampler interface {
+	LastRTT() time.Duration
+}
+
 func (plugin *BalancingPlugin) serverStateChanged(key interface{}) {
 	server, ok := key.(*BackendServer)
 	if !ok {
-		plugin.assertStarted()
-		plugin.Server.LogError(fmt.Errorf("Could not handle server fault: Failed to convert %v (%T) to *BackendServer", key, key))
+		plugin.logger.Errorw("Could not handle server fault: unexpected callback key type", "key", key, "type", fmt.Sprintf("%T", key))
 		return
 	}
+	plugin.logger.Infow("Backend server state changed", "backend_addr", server.Addr)
+	metrics.BackendStateChangesTotal.WithLabelValues(server.Addr.String()).Inc()
 	server.handleStateChanged()
+	if sampler, ok := server.Detector.(rttSampler); ok {
+		if rtt := sampler.LastRTT(); rtt > 0 {
+			server.RecordRTT(float64(rtt.Microseconds()) / 1000)
+		}
+	}
+}
+
+// migrateSession claims ownership of a session whose owning node has
+// disappeared from the cluster (see ClusterManager.Run). BalancingSession
+// itself is process-local state that lived on the failed node, so it cannot
+// be resurrected here; instead this re-publishes the session under this
+// node's ID against a freshly picked backend, so that when the client's next
+// AMP request for it arrives, NewSession routes it to a healthy server and
+// overwrites this placeholder with the real session record.
+func (plugin *BalancingPlugin) migrateSession(record SessionRecord) error {
+	server, _ := plugin.pickBackend(record.Client, plugin.eligibleBackendServers())
+	if server == nil {
+		return fmt.Errorf("No %s server available to migrate session for %s", plugin.handler.Protocol().Name(), record.Client)
+	}
+	metrics.FailoverTotal.WithLabelValues(record.BackendAddr, server.Addr.String(), "peer_node_lost").Inc()
+	record.BackendAddr = server.Addr.String()
+	record.NodeID = plugin.cluster.NodeID
+	ctx, cancel := context.WithTimeout(context.Background(), clusterPublishTimeout)
+	defer cancel()
+	return plugin.cluster.Store.Put(ctx, sessionKey(record.Plugin, record.Client), record)
 }
 
 func (plugin *BalancingPlugin) assertStarted() {
@@ -152,8 +462,7 @@ func (session *BalancingSession) StopContainingSession() error {
 }
 
 func (session *BalancingSession) LogServerError(err error) {
-	session.Plugin.assertStarted()
-	session.Plugin.Server.LogError(err)
+	session.Plugin.logger.Errorw("Server error", "session_client", session.Client, "error", err)
 }
 
 func (session *BalancingSession) Start(sendingSession protocols.PluginSessionHandler) {
@@ -167,6 +476,14 @@ func (session *BalancingSession) Tasks() []golib.Task {
 
 func (session *BalancingSession) Cleanup() error {
 	session.PrimaryServer.unregisterSession(session)
+	if cluster := session.Plugin.cluster; cluster != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), clusterPublishTimeout)
+		defer cancel()
+		key := sessionKey(session.Plugin.handler.Protocol().Name(), session.Client)
+		if err := cluster.Store.Delete(ctx, key); err != nil {
+			session.Plugin.logger.Errorw("Failed to retract session from cluster store", "session_client", session.Client, "error", err)
+		}
+	}
 	if session.failoverError == nil {
 		return session.Handler.StopRemote()
 	} else {
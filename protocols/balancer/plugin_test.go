@@ -0,0 +1,169 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+// fakeSessionHandler is a minimal BalancingSessionHandler for exercising
+// Shutdown without a real protocol session behind it.
+type fakeSessionHandler struct {
+	mutex           sync.Mutex
+	stopRemoteErr   error
+	stopRemoteCalls int
+}
+
+func (h *fakeSessionHandler) StopRemote() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.stopRemoteCalls++
+	return h.stopRemoteErr
+}
+
+func (h *fakeSessionHandler) RedirectStream(newHost string, newPort int) error { return nil }
+func (h *fakeSessionHandler) HandleServerFault() (*BackendServer, error)       { return nil, nil }
+
+func (h *fakeSessionHandler) calls() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.stopRemoteCalls
+}
+
+// newTestPlugin builds a BalancingPlugin with backendCount backends, none of
+// them wired to a real protocols.PluginServer/BalancingPluginHandler, since
+// Shutdown only ever touches BackendServers/Sessions.
+func newTestPlugin(backendCount int) (*BalancingPlugin, []*BackendServer) {
+	plugin := &BalancingPlugin{
+		BackendServers: make(BackendServerSlice, 0, backendCount),
+		logger:         protocols.NoopLogger(),
+		strategy:       LeastSessions{},
+	}
+	servers := make([]*BackendServer, backendCount)
+	for i := range servers {
+		server := &BackendServer{
+			Sessions: make(map[*BalancingSession]bool),
+			Plugin:   plugin,
+		}
+		servers[i] = server
+		plugin.BackendServers = append(plugin.BackendServers, server)
+	}
+	return plugin, servers
+}
+
+// addTestSession registers a session directly in server.Sessions, bypassing
+// registerSession (which needs a real handler/protocol behind server.Plugin).
+func addTestSession(server *BackendServer, handler BalancingSessionHandler) *BalancingSession {
+	session := &BalancingSession{PrimaryServer: server, Plugin: server.Plugin, Handler: handler}
+	server.mutex.Lock()
+	server.Sessions[session] = true
+	server.mutex.Unlock()
+	return session
+}
+
+func TestShutdownWaitsForSessionsToDrainNaturally(t *testing.T) {
+	plugin, servers := newTestPlugin(1)
+	handler := &fakeSessionHandler{}
+	session := addTestSession(servers[0], handler)
+
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		servers[0].mutex.Lock()
+		delete(servers[0].Sessions, session)
+		servers[0].mutex.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := plugin.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned error for a session that drained naturally: %v", err)
+	}
+	if !plugin.isDraining() {
+		t.Fatal("Plugin should report draining after Shutdown")
+	}
+	if calls := handler.calls(); calls != 0 {
+		t.Fatalf("StopRemote should not be called when a session drains naturally, got %d calls", calls)
+	}
+}
+
+func TestShutdownForceClosesRemainingSessionsAfterDeadline(t *testing.T) {
+	const sessionsPerBackend = 2
+	plugin, servers := newTestPlugin(2)
+	var handlers []*fakeSessionHandler
+	for _, server := range servers {
+		for i := 0; i < sessionsPerBackend; i++ {
+			handler := &fakeSessionHandler{}
+			handlers = append(handlers, handler)
+			addTestSession(server, handler)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := plugin.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned error force-closing sessions that all stopped cleanly: %v", err)
+	}
+	for i, handler := range handlers {
+		if calls := handler.calls(); calls != 1 {
+			t.Errorf("session %d: expected StopRemote to be called once after the deadline, got %d calls", i, calls)
+		}
+	}
+	if remaining := plugin.activeSessions(); len(remaining) != len(handlers) {
+		t.Fatalf("Shutdown should not itself remove sessions from BackendServer.Sessions, got %d remaining, want %d", len(remaining), len(handlers))
+	}
+}
+
+func TestEligibleBackendServersExcludesDrained(t *testing.T) {
+	plugin, servers := newTestPlugin(3)
+	servers[1].Drain()
+
+	eligible := plugin.eligibleBackendServers()
+	if len(eligible) != 2 {
+		t.Fatalf("expected 2 eligible backends with one drained, got %d", len(eligible))
+	}
+	for _, server := range eligible {
+		if server == servers[1] {
+			t.Fatal("eligibleBackendServers returned a drained backend")
+		}
+	}
+}
+
+func TestPickBackendNeverPicksADrainedServer(t *testing.T) {
+	plugin, servers := newTestPlugin(3)
+	for i, server := range servers {
+		server.Addr = fakeAddr(fmt.Sprintf("10.0.0.%d:100", i+1))
+	}
+	servers[1].Drain()
+
+	for i := 0; i < 50; i++ {
+		client := fmt.Sprintf("client-%d", i)
+		server, backups := plugin.pickBackend(client, plugin.eligibleBackendServers())
+		if server == servers[1] {
+			t.Fatalf("pickBackend picked a drained backend as primary for %q", client)
+		}
+		for _, backup := range backups {
+			if backup == servers[1] {
+				t.Fatalf("pickBackend picked a drained backend as backup for %q", client)
+			}
+		}
+	}
+}
+
+func TestShutdownReportsForceCloseErrors(t *testing.T) {
+	plugin, servers := newTestPlugin(1)
+	failing := &fakeSessionHandler{stopRemoteErr: context.DeadlineExceeded}
+	addTestSession(servers[0], failing)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := plugin.Shutdown(ctx); err == nil {
+		t.Fatal("Shutdown should return an error when a session fails to force-close")
+	}
+	if calls := failing.calls(); calls != 1 {
+		t.Fatalf("expected StopRemote to be called once, got %d", calls)
+	}
+}
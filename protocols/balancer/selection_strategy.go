@@ -0,0 +1,107 @@
+package balancer
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// SelectionStrategy decides which backend handles a new session and which
+// backends act as its failover candidates. BalancingPlugin calls Pick once
+// per NewSession instead of relying on a fixed sort order, so different
+// plugins can trade off affinity, fairness, and latency differently.
+type SelectionStrategy interface {
+	// Pick returns the primary backend for client, plus up to
+	// num_backup_servers backups in preference order. servers is never empty
+	// when Pick is called; primary may be nil if none qualify for primary.
+	Pick(client string, servers BackendServerSlice) (primary *BackendServer, backups BackendServerSlice)
+}
+
+// StrategyByName resolves a SelectionStrategy from its config-file name, for
+// use with NewBalancingPluginWithStrategy. Each call returns a fresh
+// instance, since RoundRobin keeps per-instance state.
+func StrategyByName(name string) (SelectionStrategy, error) {
+	switch name {
+	case "", "least_sessions":
+		return LeastSessions{}, nil
+	case "round_robin":
+		return &RoundRobin{}, nil
+	case "consistent_hash":
+		return &ConsistentHash{}, nil
+	case "weighted_random":
+		return WeightedRandom{}, nil
+	case "latency_aware":
+		return LatencyAware{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown selection strategy %q", name)
+	}
+}
+
+// backups splits off up to num_backup_servers entries following primary in
+// ranked, the order all strategies agree backups should be tried in.
+func backups(primary *BackendServer, ranked BackendServerSlice) BackendServerSlice {
+	result := make(BackendServerSlice, 0, num_backup_servers)
+	for _, server := range ranked {
+		if server == primary {
+			continue
+		}
+		if len(result) >= num_backup_servers {
+			break
+		}
+		result = append(result, server)
+	}
+	return result
+}
+
+// LeastSessions picks the backend with the fewest active sessions, breaking
+// ties by address for determinism. This is the strategy that matches the
+// pre-existing (implicit, sort-at-registration) behavior most closely.
+type LeastSessions struct{}
+
+func (LeastSessions) Pick(client string, servers BackendServerSlice) (*BackendServer, BackendServerSlice) {
+	ranked := append(BackendServerSlice(nil), servers...)
+	sortStable(ranked, func(i, j int) bool {
+		a, b := ranked[i].SessionCount(), ranked[j].SessionCount()
+		if a != b {
+			return a < b
+		}
+		return ranked[i].Addr.String() < ranked[j].Addr.String()
+	})
+	if len(ranked) == 0 {
+		return nil, nil
+	}
+	return ranked[0], backups(ranked[0], ranked)
+}
+
+// RoundRobin cycles through servers in registration order, independent of
+// client or load. counter is shared across all Pick calls for this strategy
+// instance, matching one RoundRobin per plugin; Pick is called concurrently
+// from BalancingPlugin.NewSession, so counter is only ever touched via
+// sync/atomic.
+type RoundRobin struct {
+	counter uint64
+}
+
+func (r *RoundRobin) Pick(client string, servers BackendServerSlice) (*BackendServer, BackendServerSlice) {
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	ranked := append(BackendServerSlice(nil), servers...)
+	sortStable(ranked, func(i, j int) bool {
+		return ranked[i].Addr.String() < ranked[j].Addr.String()
+	})
+	index := int((atomic.AddUint64(&r.counter, 1) - 1) % uint64(len(ranked)))
+	primary := ranked[index]
+	rotated := append(append(BackendServerSlice(nil), ranked[index+1:]...), ranked[:index]...)
+	return primary, backups(primary, rotated)
+}
+
+// sortStable avoids importing sort in every strategy file; kept tiny on
+// purpose since BackendServerSlice is expected to stay small (tens of
+// backends, not thousands).
+func sortStable(s BackendServerSlice, less func(i, j int) bool) {
+	for i := 1; i < len(s); i++ {
+		for j := i; j > 0 && less(j, j-1); j-- {
+			s[j], s[j-1] = s[j-1], s[j]
+		}
+	}
+}
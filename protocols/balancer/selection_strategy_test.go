@@ -0,0 +1,143 @@
+package balancer
+
+import (
+	"testing"
+)
+
+// fakeAddr is a minimal net.Addr for building BackendServers in tests
+// without a real listener.
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "tcp" }
+func (a fakeAddr) String() string  { return string(a) }
+
+func TestRoundRobinCyclesThroughAllServers(t *testing.T) {
+	s1 := &BackendServer{Addr: fakeAddr("10.0.0.1:100")}
+	s2 := &BackendServer{Addr: fakeAddr("10.0.0.2:100")}
+	s3 := &BackendServer{Addr: fakeAddr("10.0.0.3:100")}
+	servers := BackendServerSlice{s3, s1, s2} // deliberately unsorted
+
+	rr := &RoundRobin{}
+	var got []*BackendServer
+	for i := 0; i < 9; i++ {
+		primary, _ := rr.Pick("client", servers)
+		got = append(got, primary)
+	}
+
+	for cycle := 0; cycle < 3; cycle++ {
+		seen := make(map[*BackendServer]bool, 3)
+		for i := 0; i < 3; i++ {
+			seen[got[cycle*3+i]] = true
+		}
+		if len(seen) != 3 {
+			t.Fatalf("cycle %d did not visit all 3 servers exactly once: %v", cycle, got[cycle*3:cycle*3+3])
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if got[i] != got[i+3] || got[i] != got[i+6] {
+			t.Fatalf("RoundRobin should repeat the same order every 3 picks; pick %d was %v, %v, %v", i, got[i], got[i+3], got[i+6])
+		}
+	}
+}
+
+func TestConsistentHashIsDeterministic(t *testing.T) {
+	s1 := &BackendServer{Addr: fakeAddr("10.0.0.1:100")}
+	s2 := &BackendServer{Addr: fakeAddr("10.0.0.2:100")}
+	s3 := &BackendServer{Addr: fakeAddr("10.0.0.3:100")}
+	servers := BackendServerSlice{s1, s2, s3}
+
+	hash := &ConsistentHash{}
+	primary, backups := hash.Pick("client-a", servers)
+	if primary == nil {
+		t.Fatal("Pick returned a nil primary for a non-empty server set")
+	}
+	for i := 0; i < 10; i++ {
+		gotPrimary, gotBackups := hash.Pick("client-a", servers)
+		if gotPrimary != primary {
+			t.Fatalf("Pick(%q) not deterministic: got %v, want %v", "client-a", gotPrimary, primary)
+		}
+		if len(gotBackups) != len(backups) {
+			t.Fatalf("Pick(%q) backups not deterministic: got %v, want %v", "client-a", gotBackups, backups)
+		}
+	}
+}
+
+func TestConsistentHashStableAcrossBackendChurn(t *testing.T) {
+	s1 := &BackendServer{Addr: fakeAddr("10.0.0.1:100")}
+	s2 := &BackendServer{Addr: fakeAddr("10.0.0.2:100")}
+	s3 := &BackendServer{Addr: fakeAddr("10.0.0.3:100")}
+	hash := &ConsistentHash{}
+
+	clients := []string{"client-a", "client-b", "client-c", "client-d", "client-e", "client-f"}
+	before := make(map[string]*BackendServer, len(clients))
+	for _, c := range clients {
+		primary, _ := hash.Pick(c, BackendServerSlice{s1, s2, s3})
+		before[c] = primary
+	}
+
+	// Adding a 4th backend should remap only a minority of clients onto the
+	// ring (Ketama's whole point), not every one of them.
+	s4 := &BackendServer{Addr: fakeAddr("10.0.0.4:100")}
+	unchanged := 0
+	for _, c := range clients {
+		primary, _ := hash.Pick(c, BackendServerSlice{s1, s2, s3, s4})
+		if primary == before[c] {
+			unchanged++
+		}
+	}
+	if unchanged == 0 {
+		t.Fatalf("expected at least some clients to keep their primary after adding a backend, got 0/%d unchanged", len(clients))
+	}
+}
+
+func TestConsistentHashEmptyServers(t *testing.T) {
+	hash := &ConsistentHash{}
+	primary, backups := hash.Pick("client", nil)
+	if primary != nil || backups != nil {
+		t.Fatalf("Pick with no servers should return (nil, nil), got (%v, %v)", primary, backups)
+	}
+}
+
+func TestWeightedRandomRespectsWeight(t *testing.T) {
+	heavy := &BackendServer{Addr: fakeAddr("10.0.0.1:100"), Weight: 3}
+	light := &BackendServer{Addr: fakeAddr("10.0.0.2:100"), Weight: 1}
+	servers := BackendServerSlice{heavy, light}
+	strategy := WeightedRandom{}
+
+	const trials = 20000
+	counts := make(map[*BackendServer]int, 2)
+	for i := 0; i < trials; i++ {
+		primary, _ := strategy.Pick("client", servers)
+		counts[primary]++
+	}
+	if counts[heavy] == 0 || counts[light] == 0 {
+		t.Fatalf("expected both backends to be picked at least once, got heavy=%d light=%d", counts[heavy], counts[light])
+	}
+	ratio := float64(counts[heavy]) / float64(counts[light])
+	if ratio < 2.0 || ratio > 4.5 {
+		t.Fatalf("expected the weight-3 backend to be picked roughly 3x as often as the weight-1 one, got ratio %.2f (heavy=%d light=%d)", ratio, counts[heavy], counts[light])
+	}
+}
+
+func TestLatencyAwarePrefersLowerRTT(t *testing.T) {
+	fast := &BackendServer{Addr: fakeAddr("10.0.0.1:100")}
+	slow := &BackendServer{Addr: fakeAddr("10.0.0.2:100")}
+	fast.RecordRTT(5)
+	slow.RecordRTT(500)
+	servers := BackendServerSlice{fast, slow}
+	strategy := LatencyAware{}
+
+	const trials = 200
+	slowPicks := 0
+	for i := 0; i < trials; i++ {
+		primary, _ := strategy.Pick("client", servers)
+		if primary == slow {
+			slowPicks++
+		}
+	}
+	// p2c always samples both of these two servers and keeps the lower-RTT
+	// one, so with only two backends the slow one should never win.
+	if slowPicks != 0 {
+		t.Fatalf("expected the higher-RTT backend to never be picked with only 2 servers, got %d/%d picks", slowPicks, trials)
+	}
+}
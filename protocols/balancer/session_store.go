@@ -0,0 +1,70 @@
+package balancer
+
+import (
+	"context"
+)
+
+// SessionRecord is the piece of BalancingSession state that is replicated
+// across a balancer cluster: enough for a peer to know which node currently
+// owns a client and which backend it was routed to.
+type SessionRecord struct {
+	Client      string
+	Plugin      string
+	BackendAddr string
+	NodeID      string
+}
+
+// EventType describes a change reported by SessionStore.Watch.
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+// SessionEvent is delivered over the channel returned by Watch whenever a
+// session record changes anywhere in the cluster.
+type SessionEvent struct {
+	Type   EventType
+	Key    string
+	Record SessionRecord
+}
+
+// NodeEvent is delivered over the channel returned by WatchNodes whenever a
+// node's liveness key appears or disappears. A NodeEvent{Type: EventDelete}
+// is the only reliable failure signal ClusterManager acts on: unlike a
+// session key, a node's liveness key is only ever removed by its lease
+// expiring (see EtcdSessionStore.PutNode), never by an explicit Delete call
+// during normal operation.
+type NodeEvent struct {
+	Type   EventType
+	NodeID string
+}
+
+// SessionStore replicates BalancingSession ownership across a cluster of
+// amp_balancer nodes, so that on node failure a peer can detect the lost
+// lease and take over the affected sessions (see ClusterManager). PutNode
+// and WatchNodes track node liveness separately from session ownership,
+// since a session's key is deleted both on node failure and on ordinary,
+// healthy session end (BalancingSession.Cleanup) and the two can't be told
+// apart from the session keyspace alone.
+type SessionStore interface {
+	Put(ctx context.Context, key string, record SessionRecord) error
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context) (map[string]SessionRecord, error)
+	Watch(ctx context.Context) (<-chan SessionEvent, error)
+
+	// PutNode marks nodeID alive under the store's lease. It only needs to
+	// be called once per process; the lease keep-alive already running in
+	// the store keeps it alive until the process stops renewing it.
+	PutNode(ctx context.Context, nodeID string) error
+	WatchNodes(ctx context.Context) (<-chan NodeEvent, error)
+
+	Close() error
+}
+
+// sessionKey builds the store key for a session, namespaced by plugin so
+// that amp and pcp sessions for the same client don't collide.
+func sessionKey(pluginName, client string) string {
+	return pluginName + "/" + client
+}
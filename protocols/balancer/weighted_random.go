@@ -0,0 +1,51 @@
+package balancer
+
+import "math/rand"
+
+// WeightedRandom picks a primary with probability proportional to each
+// backend's Weight (BackendServer.Weight, defaulting to 1), so operators can
+// send more traffic to bigger backends without disabling the others.
+type WeightedRandom struct {
+	Rand *rand.Rand // nil uses the default global source
+}
+
+func (w WeightedRandom) Pick(client string, servers BackendServerSlice) (*BackendServer, BackendServerSlice) {
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	total := 0.0
+	for _, server := range servers {
+		total += server.weight()
+	}
+	r := w.float64()
+	target := r * total
+	var primary *BackendServer
+	sum := 0.0
+	for _, server := range servers {
+		sum += server.weight()
+		if target < sum {
+			primary = server
+			break
+		}
+	}
+	if primary == nil {
+		primary = servers[len(servers)-1]
+	}
+	remaining := make(BackendServerSlice, 0, len(servers)-1)
+	for _, server := range servers {
+		if server != primary {
+			remaining = append(remaining, server)
+		}
+	}
+	if len(remaining) > num_backup_servers {
+		remaining = remaining[:num_backup_servers]
+	}
+	return primary, remaining
+}
+
+func (w WeightedRandom) float64() float64 {
+	if w.Rand != nil {
+		return w.Rand.Float64()
+	}
+	return rand.Float64()
+}
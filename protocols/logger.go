@@ -0,0 +1,56 @@
+package protocols
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Logger is the structured-logging interface used throughout the protocols
+// packages and their consumers (balancer, amp, proxies/...). It mirrors the
+// subset of zap.SugaredLogger used by this codebase so that call sites can
+// attach structured fields (e.g. "session_client", "backend_addr", "plugin")
+// instead of formatting ad-hoc strings.
+type Logger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+
+	// Named returns a descendant logger that prefixes all messages with the
+	// given name, e.g. Named("balancer").Named("amp").
+	Named(name string) Logger
+}
+
+type zapLogger struct {
+	*zap.SugaredLogger
+}
+
+func (l *zapLogger) Named(name string) Logger {
+	return &zapLogger{l.SugaredLogger.Named(name)}
+}
+
+// NewLogger builds a Logger backed by go.uber.org/zap. format must be
+// "json" or "console", level must be one of the zapcore level names
+// ("debug", "info", "warn", "error").
+func NewLogger(level string, format string) (Logger, error) {
+	var zapLevel zapcore.Level
+	if err := zapLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	config := zap.NewProductionConfig()
+	if format == "console" {
+		config = zap.NewDevelopmentConfig()
+	}
+	config.Level = zap.NewAtomicLevelAt(zapLevel)
+	logger, err := config.Build()
+	if err != nil {
+		return nil, err
+	}
+	return &zapLogger{logger.Sugar()}, nil
+}
+
+// NoopLogger is a Logger that discards everything. Useful as a default when
+// no logger is configured, so components do not need to nil-check.
+func NoopLogger() Logger {
+	return &zapLogger{zap.NewNop().Sugar()}
+}
@@ -0,0 +1,44 @@
+// Package metrics holds the Prometheus collectors shared by the protocols
+// and balancer packages, so every server/plugin instruments the same
+// metric names regardless of which process registers them.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	AMPRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "amp_requests_total",
+		Help: "Total AMP requests handled, by request code and outcome.",
+	}, []string{"code", "status"})
+
+	BalancerSessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "balancer_sessions",
+		Help: "Active sessions per plugin and backend.",
+	}, []string{"plugin", "backend"})
+
+	BackendStateChangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_state_changes_total",
+		Help: "Backend up/down transitions, by backend address.",
+	}, []string{"backend"})
+
+	FaultDetectorRTTSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fault_detector_rtt_seconds",
+		Help:    "Round-trip time observed by fault detectors, by backend.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	FailoverTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "failover_total",
+		Help: "Session failovers, by source backend, destination backend, and reason.",
+	}, []string{"from", "to", "reason"})
+)
+
+// Status labels used with AMPRequestsTotal; kept as constants so call sites
+// don't sprinkle "ok"/"error" string literals around.
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
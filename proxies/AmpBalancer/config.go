@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the typed schema behind --config, replacing the compile-time
+// server lists and boolean flags this binary used to require a rebuild to
+// change. See balancer.yaml.example for a documented sample.
+type Config struct {
+	Listen        ListenConfig        `yaml:"listen"`
+	Backends      []BackendConfig     `yaml:"backends"`
+	FaultDetector FaultDetectorConfig `yaml:"fault_detector"`
+	Strategy      string              `yaml:"strategy"` // least_sessions|round_robin|consistent_hash|weighted_random|latency_aware
+	Logging       LoggingConfig       `yaml:"logging"`
+	Metrics       MetricsConfig       `yaml:"metrics"`
+	Cluster       ClusterConfig       `yaml:"cluster"`
+	TLS           TLSConfig           `yaml:"tls"`
+	ShutdownTimeout time.Duration     `yaml:"shutdown_timeout"`
+}
+
+type ListenConfig struct {
+	AMP string `yaml:"amp"`
+}
+
+// BackendConfig describes one backend media server. Plugin selects which
+// BalancingPlugin it is registered with ("amp" or "pcp"); Role lets an
+// operator mark a backend as never eligible to be primary. Address is
+// normally "host:port" for the legacy AMP transport; an "amp" backend may
+// instead use a "grpc://host:port" address to connect over the gRPC AMP
+// transport (see balancer.BalancingPlugin.SetGRPCOptions for the TLS used).
+type BackendConfig struct {
+	Address string   `yaml:"address"`
+	Plugin  string   `yaml:"plugin"`
+	Weight  float64  `yaml:"weight"`
+	Role    string   `yaml:"role"` // "primary" (default) or "backup-only"
+	Tags    []string `yaml:"tags"`
+}
+
+type FaultDetectorConfig struct {
+	Kind               string        `yaml:"kind"` // "ping" (default) or "heartbeat"
+	HeartbeatListen    string        `yaml:"heartbeat_listen"`
+	HeartbeatFrequency time.Duration `yaml:"heartbeat_frequency"`
+	HeartbeatTimeout   time.Duration `yaml:"heartbeat_timeout"`
+}
+
+type LoggingConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+type MetricsConfig struct {
+	Addr      string `yaml:"addr"`
+	DebugAddr string `yaml:"debug_addr"`
+}
+
+type ClusterConfig struct {
+	Peers  []string `yaml:"peers"`
+	NodeID string   `yaml:"node_id"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	CAFile   string `yaml:"ca_file"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:          ListenConfig{AMP: "0.0.0.0:7779"},
+		FaultDetector:   FaultDetectorConfig{Kind: "ping"},
+		Strategy:        "least_sessions",
+		Logging:         LoggingConfig{Level: "info", Format: "console"},
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// LoadConfig reads and parses the YAML file at path, filling in defaults for
+// anything left unset.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config file %v: %v", path, err)
+	}
+	config := defaultConfig()
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Error parsing config file %v: %v", path, err)
+	}
+	return config, nil
+}
+
+// buildTLSConfig turns the tls block into a *tls.Config for etcd/gRPC
+// clients, or returns nil if no certificate was configured.
+func (t TLSConfig) buildTLSConfig() (*tls.Config, error) {
+	if t.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading TLS certificate/key: %v", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if t.CAFile != "" {
+		caData, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading TLS CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("Error parsing TLS CA file %v: no certificates found", t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// backendsFor returns the backend configs belonging to the given plugin
+// name ("amp" or "pcp"), keyed by address for easy diffing on reload.
+func (c *Config) backendsFor(plugin string) map[string]BackendConfig {
+	result := make(map[string]BackendConfig)
+	for _, backend := range c.Backends {
+		if backend.Plugin == plugin {
+			result[backend.Address] = backend
+		}
+	}
+	return result
+}
@@ -2,11 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/protocols/amp"
 	"github.com/antongulenko/RTP/protocols/balancer"
@@ -16,122 +25,304 @@ import (
 	"github.com/antongulenko/golib"
 )
 
-var (
-	load_servers     = []string{"127.0.0.1:7770"}
-	amp_servers      = []string{"127.0.0.1:7777"}
-	pcp_servers      = []string{"127.0.0.1:7778", "127.0.0.1:7776"}
-	heartbeat_server = "127.0.0.1:0" // Random port
-)
-
-func printServerErrors(servername string, server *protocols.Server) {
+func printServerErrors(servername string, server *protocols.Server, logger protocols.Logger) {
 	for err := range server.Errors() {
-		log.Println(servername + " error: " + err.Error())
+		logger.Errorw("Server error", "server", servername, "error", err)
 	}
 }
 
-func printSessionStarted(session *protocols.PluginSession) {
+func printSessionStarted(session *protocols.PluginSession, logger protocols.Logger) {
 	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "Started session for %v (", session.Client)
 	for i, plugin := range session.Plugins {
 		if i != 0 {
 			fmt.Fprintf(&buf, ", ")
 		}
 		fmt.Fprintf(&buf, "%v", plugin)
 	}
-	fmt.Fprintf(&buf, ")")
-	log.Println(buf.String())
+	logger.Infow("Session started", "session_client", session.Client, "plugins", buf.String())
 }
 
-func printSessionStopped(session *protocols.PluginSession) {
-	log.Printf("Stopped session for %v\n", session.Client)
+func printSessionStopped(session *protocols.PluginSession, logger protocols.Logger) {
+	logger.Infow("Session stopped", "session_client", session.Client)
 }
 
-func stateChangePrinter(key interface{}) {
-	breaker, ok := key.(protocols.CircuitBreaker)
-	if !ok {
-		log.Printf("Failed to convert %v (%T) to CircuitBreaker\n", key, key)
-		return
-	}
-	err, server := breaker.Error(), breaker.String()
-	if err != nil {
-		log.Printf("%s down: %v\n", server, err)
-	} else {
-		log.Printf("%s up\n", server)
+func stateChangePrinter(logger protocols.Logger) protocols.FaultDetectorCallback {
+	return func(key interface{}) {
+		breaker, ok := key.(protocols.CircuitBreaker)
+		if !ok {
+			logger.Errorw("Failed to convert callback key to CircuitBreaker", "key", key, "type", fmt.Sprintf("%T", key))
+			return
+		}
+		if err := breaker.Error(); err != nil {
+			logger.Warnw("Backend down", "backend_addr", breaker.String(), "error", err)
+		} else {
+			logger.Infow("Backend up", "backend_addr", breaker.String())
+		}
 	}
 }
 
-func main() {
-	loadBackend := flag.Bool("load", false, "Use Load servers to create the streams, instead of regular AMP Media servers")
-	useHeartbeat := flag.Bool("heartbeat", false, "Use heartbeat-based fault detection instead of active ping-based detection")
-	_heartbeat_frequency := flag.Uint("heartbeat_frequency", 200, "Time between two heartbeats which observers will send (milliseconds)")
-	_heartbeat_timeout := flag.Uint("heartbeat_timeout", 350, "Time between two heartbeats before assuming offline server (milliseconds)")
-	amp_addr := protocols.ParseServerFlags("0.0.0.0", 7779)
-	heartbeat_frequency := time.Duration(*_heartbeat_frequency) * time.Millisecond
-	heartbeat_timeout := time.Duration(*_heartbeat_timeout) * time.Millisecond
-
-	var detector_factory balancer.FaultDetectorFactory
-	tasks := golib.NewTaskGroup()
-	var heartbeatServer *heartbeat.HeartbeatServer
-	if *useHeartbeat {
-		var err error
-		heartbeatServer, err = heartbeat.NewHeartbeatServer(heartbeat_server)
-		golib.Checkerr(err)
-		go printServerErrors("Heartbeat", heartbeatServer.Server)
-		log.Println("Listening for Heartbeats on", heartbeatServer.LocalAddr())
-		detector_factory = func(endpoint string) (protocols.FaultDetector, error) {
-			return heartbeatServer.ObserveServer(endpoint, heartbeat_frequency, heartbeat_timeout)
-		}
-		tasks.AddNamed("heartbeat", heartbeatServer)
-	} else {
-		detector_factory = func(endpoint string) (protocols.FaultDetector, error) {
+// makeDetectorFactory builds the FaultDetectorFactory selected by
+// config.FaultDetector, starting a shared HeartbeatServer (added to tasks)
+// when Kind is "heartbeat".
+func makeDetectorFactory(config FaultDetectorConfig, tasks *golib.TaskGroup, logger protocols.Logger) (balancer.FaultDetectorFactory, error) {
+	switch config.Kind {
+	case "", "ping":
+		return func(endpoint string) (protocols.FaultDetector, error) {
 			detector, err := ping.DialNewFaultDetector(endpoint)
 			if err != nil {
 				return nil, err
 			}
 			detector.Start()
 			return detector, nil
+		}, nil
+	case "heartbeat":
+		heartbeatServer, err := heartbeat.NewHeartbeatServer(config.HeartbeatListen)
+		if err != nil {
+			return nil, fmt.Errorf("Error starting heartbeat server: %v", err)
+		}
+		go printServerErrors("Heartbeat", heartbeatServer.Server, logger.Named("heartbeat"))
+		logger.Infow("Listening for heartbeats", "addr", heartbeatServer.LocalAddr())
+		tasks.AddNamed("heartbeat", heartbeatServer)
+		frequency, timeout := config.HeartbeatFrequency, config.HeartbeatTimeout
+		if frequency <= 0 {
+			frequency = 200 * time.Millisecond
+		}
+		if timeout <= 0 {
+			timeout = 350 * time.Millisecond
+		}
+		return func(endpoint string) (protocols.FaultDetector, error) {
+			return heartbeatServer.ObserveServer(endpoint, frequency, timeout)
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unknown fault_detector.kind %q, expected \"ping\" or \"heartbeat\"", config.Kind)
+	}
+}
+
+// applyBackends reconciles plugin's registered backends with the desired set
+// from the config file: new addresses are added, addresses no longer present
+// are removed, and addresses that stick around have their Weight/Role
+// updated in place (their sessions are untouched either way). Used both for
+// the initial setup and for SIGHUP reloads.
+func applyBackends(plugin *balancer.BalancingPlugin, pluginName string, desired map[string]BackendConfig, logger protocols.Logger) {
+	current := plugin.Backends()
+	existing := make(map[string]bool, len(current))
+	for _, backend := range current {
+		existing[backend.Addr.String()] = true
+	}
+	for addr := range existing {
+		if _, ok := desired[addr]; !ok {
+			if err := plugin.RemoveBackendServer(addr); err != nil {
+				logger.Errorw("Failed to remove backend", "backend_addr", addr, "error", err)
+			}
+		}
+	}
+	for addr, backend := range desired {
+		opts := balancer.BackendOptions{Weight: backend.Weight, Role: backend.Role}
+		if !existing[addr] {
+			if err := plugin.AddBackendServer(addr, opts, stateChangePrinter(logger.Named(pluginName))); err != nil {
+				logger.Errorw("Failed to add backend", "backend_addr", addr, "error", err)
+			}
+			continue
+		}
+		if err := plugin.UpdateBackendServer(addr, opts); err != nil {
+			logger.Errorw("Failed to update backend", "backend_addr", addr, "error", err)
 		}
 	}
+}
+
+// watchConfigReload re-reads configPath on every SIGHUP and calls
+// applyBackends for each plugin, so backends can be added/removed without
+// restarting the process.
+func watchConfigReload(configPath string, logger protocols.Logger, plugins map[string]*balancer.BalancingPlugin) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			logger.Infow("Received SIGHUP, reloading config", "path", configPath)
+			config, err := LoadConfig(configPath)
+			if err != nil {
+				logger.Errorw("Failed to reload config, keeping previous backends", "error", err)
+				continue
+			}
+			for name, plugin := range plugins {
+				applyBackends(plugin, name, config.backendsFor(name), logger)
+			}
+		}
+	}()
+}
+
+// setupClustering connects to the etcd peers given by cluster.peers (if
+// any), wires a ClusterManager into each plugin so their sessions are
+// published/retracted from the shared store, and exposes /cluster/state on
+// the debug HTTP server so operators can inspect current ownership.
+func setupClustering(config ClusterConfig, tlsConfig TLSConfig, defaultNodeID string, logger protocols.Logger, mux *http.ServeMux, plugins ...*balancer.BalancingPlugin) error {
+	if len(config.Peers) == 0 {
+		return nil
+	}
+	nodeID := config.NodeID
+	if nodeID == "" {
+		nodeID = defaultNodeID
+	}
+	tls, err := tlsConfig.buildTLSConfig()
+	if err != nil {
+		return err
+	}
+	store, err := balancer.NewEtcdSessionStore(config.Peers, "/amp_balancer/", 10*time.Second, tls)
+	if err != nil {
+		return fmt.Errorf("Error setting up cluster session store: %v", err)
+	}
+	for _, plugin := range plugins {
+		manager := balancer.NewClusterManager(nodeID, store, plugin)
+		go func() {
+			if err := manager.Run(context.Background()); err != nil {
+				logger.Errorw("Cluster manager stopped", "error", err)
+			}
+		}()
+	}
+	mux.HandleFunc("/cluster/state", func(w http.ResponseWriter, r *http.Request) {
+		state, err := store.List(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(state)
+	})
+	return nil
+}
+
+// registerDrainEndpoint wires POST /backends/{addr}/drain into mux: it marks
+// the given backend (searched across all plugins) as draining, so rolling
+// restarts of a single backend can empty it out before it's taken down.
+func registerDrainEndpoint(mux *http.ServeMux, plugins ...*balancer.BalancingPlugin) {
+	mux.HandleFunc("/backends/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/drain") {
+			http.NotFound(w, r)
+			return
+		}
+		addr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/backends/"), "/drain")
+		for _, plugin := range plugins {
+			for _, backend := range plugin.Backends() {
+				if backend.Addr.String() == addr {
+					backend.Drain()
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+			}
+		}
+		http.Error(w, fmt.Sprintf("No backend registered for address %q", addr), http.StatusNotFound)
+	})
+}
+
+// handleGracefulShutdown blocks until SIGTERM, then drains each plugin
+// (rejecting new sessions and waiting up to shutdownTimeout for existing
+// ones to finish naturally before force-closing them) and exits the process.
+// Rolling restarts of the whole balancer should send SIGTERM rather than
+// SIGKILL so active RTP streams get a chance to end cleanly.
+func handleGracefulShutdown(shutdownTimeout time.Duration, logger protocols.Logger, plugins ...*balancer.BalancingPlugin) {
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	go func() {
+		<-sigterm
+		logger.Infow("Received SIGTERM, draining sessions before shutdown", "timeout", shutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		for _, plugin := range plugins {
+			if err := plugin.Shutdown(ctx); err != nil {
+				logger.Errorw("Error during plugin shutdown", "error", err)
+			}
+		}
+		os.Exit(0)
+	}()
+}
+
+// serveMetrics starts an HTTP server exposing /metrics (Prometheus) and
+// /debug/pprof/* (CPU/heap profiles) on addr, so production instances can be
+// scraped and profiled without restarting with special flags.
+func serveMetrics(addr string, logger protocols.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Errorw("Metrics HTTP server stopped", "error", err)
+		}
+	}()
+	logger.Infow("Serving metrics and pprof", "addr", addr)
+}
+
+func main() {
+	configPath := flag.String("config", "balancer.yaml", "Path to the balancer YAML config file")
+	flag.Parse()
+
+	config, err := LoadConfig(*configPath)
+	golib.Checkerr(err)
+
+	logger, err := protocols.NewLogger(config.Logging.Level, config.Logging.Format)
+	golib.Checkerr(err)
+
+	tasks := golib.NewTaskGroup()
+	detector_factory, err := makeDetectorFactory(config.FaultDetector, tasks, logger)
+	golib.Checkerr(err)
+
+	strategy, err := balancer.StrategyByName(config.Strategy)
+	golib.Checkerr(err)
 
 	protocol, err := protocols.NewProtocol("AMP", amp.Protocol, ping.Protocol, heartbeat.Protocol)
 	golib.Checkerr(err)
-	baseServer, err := protocols.NewServer(amp_addr, protocol)
+	baseServer, err := protocols.NewServer(config.Listen.AMP, protocol)
 	golib.Checkerr(err)
 	server, err := amp_balancer.RegisterPluginServer(baseServer)
 	golib.Checkerr(err)
 	tasks.AddNamed("server", server)
 
-	ampPlugin := amp_balancer.NewAmpBalancingPlugin(detector_factory)
+	ampPlugin := amp_balancer.NewAmpBalancingPluginWithStrategy(detector_factory, logger, strategy)
 	server.AddPlugin(ampPlugin)
-	pcpPlugin := amp_balancer.NewPcpBalancingPlugin(detector_factory)
+	pcpPlugin := amp_balancer.NewPcpBalancingPluginWithStrategy(detector_factory, logger, strategy)
 	server.AddPlugin(pcpPlugin)
 
-	if *loadBackend {
-		for _, load := range load_servers {
-			err := ampPlugin.AddBackendServer(load, stateChangePrinter)
-			golib.Checkerr(err)
-		}
-	} else {
-		for _, amp := range amp_servers {
-			err := ampPlugin.AddBackendServer(amp, stateChangePrinter)
-			golib.Checkerr(err)
-		}
+	grpcTLS, err := config.TLS.buildTLSConfig()
+	golib.Checkerr(err)
+	ampPlugin.BalancingPlugin.SetGRPCOptions(amp.GRPCOptions{TLSConfig: grpcTLS})
+
+	applyBackends(ampPlugin.BalancingPlugin, "amp", config.backendsFor("amp"), logger)
+	applyBackends(pcpPlugin.BalancingPlugin, "pcp", config.backendsFor("pcp"), logger)
+	watchConfigReload(*configPath, logger, map[string]*balancer.BalancingPlugin{
+		"amp": ampPlugin.BalancingPlugin,
+		"pcp": pcpPlugin.BalancingPlugin,
+	})
+
+	debugMux := http.NewServeMux()
+	err = setupClustering(config.Cluster, config.TLS, config.Listen.AMP, logger.Named("cluster"), debugMux, ampPlugin.BalancingPlugin, pcpPlugin.BalancingPlugin)
+	golib.Checkerr(err)
+	registerDrainEndpoint(debugMux, ampPlugin.BalancingPlugin, pcpPlugin.BalancingPlugin)
+	handleGracefulShutdown(config.ShutdownTimeout, logger, ampPlugin.BalancingPlugin, pcpPlugin.BalancingPlugin)
+	if config.Metrics.DebugAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(config.Metrics.DebugAddr, debugMux); err != nil {
+				logger.Errorw("Debug HTTP server stopped", "error", err)
+			}
+		}()
+		logger.Infow("Serving debug endpoints", "addr", config.Metrics.DebugAddr)
 	}
-	for _, pcp := range pcp_servers {
-		err := pcpPlugin.AddBackendServer(pcp, stateChangePrinter)
-		golib.Checkerr(err)
+	if config.Metrics.Addr != "" {
+		serveMetrics(config.Metrics.Addr, logger.Named("metrics"))
 	}
 
-	go printServerErrors("Server", server.Server)
-	server.SessionStartedCallback = printSessionStarted
-	server.SessionStoppedCallback = printSessionStopped
+	go printServerErrors("Server", server.Server, logger)
+	server.SessionStartedCallback = func(session *protocols.PluginSession) {
+		printSessionStarted(session, logger)
+	}
+	server.SessionStoppedCallback = func(session *protocols.PluginSession) {
+		printSessionStopped(session, logger)
+	}
 
-	log.Println("Listening to AMP on " + amp_addr)
-	log.Println("Press Ctrl-C to close")
+	logger.Infow("Listening to AMP", "addr", config.Listen.AMP)
 
-	if heartbeatServer != nil {
-		tasks.Add(heartbeatServer)
-	}
 	tasks.Add(&golib.NoopTask{golib.ExternalInterrupt(), "external interrupt"})
 	tasks.WaitAndExit()
 }